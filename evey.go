@@ -5,6 +5,7 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"io/ioutil"
 	"log"
@@ -12,8 +13,12 @@ import (
 	"os"
 	"path"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 /*    understand/
@@ -21,12 +26,16 @@ import (
  *
  *    way/
  * Initialize the state, load existing logs, set up the client
- * request handlers and start our server.
+ * request handlers, start the background retention sweeper, and
+ * start our server.
  */
 func main() {
   state := initState()
-	loadLogs(state)
+	if err := loadLogs(state); err != nil {
+		log.Fatal("Failed to read:", state.db, err)
+	}
   setupRequestHandlers(state)
+	go retentionLoop(state)
 
 	log.Println("Starting server on", state.addr, "writing to", state.db)
 	log.Fatal(http.ListenAndServe(state.addr, nil))
@@ -49,12 +58,22 @@ func setupRequestHandlers(state *state) {
 
 	http.HandleFunc("/put/", with_state(put))
 	http.HandleFunc("/get/", with_state(get))
+	http.HandleFunc("/follow/", with_state(follow))
+	http.HandleFunc("/next/", with_state(nextMsg))
+	http.HandleFunc("/commit/", with_state(commit))
+	http.HandleFunc("/admin/fsck/", with_state(fsck))
+	http.HandleFunc("/admin/retain/", with_state(setRetention))
 
 }
 
 /*    way/
- * Get the queue name from the URL and the message from the
- * body and save the message to the queue
+ * Get the queue name from the URL and the message from the body
+ * and save the message to the queue. A client that set
+ * Content-Length gets a cheap early reject without reading the
+ * body at all; a chunked request (no Content-Length) instead has
+ * its body read through an `io.LimitReader` capped one byte past
+ * the max, so the cap is enforced on what's actually read rather
+ * than trusted from a header the client could simply omit.
  */
 func put(state *state, r *http.Request, w http.ResponseWriter) {
 	name := getQueueName(r)
@@ -62,21 +81,34 @@ func put(state *state, r *http.Request, w http.ResponseWriter) {
 		err_("put: Invalid/Missing queue name", 400, w)
 		return
 	}
-	hlen := r.Header["Content-Length"]
-	if len(hlen) == 0 {
-		err_("put: No content-length found", 400, w)
-		return
-	}
-	len_, err := strconv.ParseUint(hlen[0], 10, 32)
-	if err != nil {
-		err_("put: Invalid content-length", 400, w)
-		return
-	}
-	if len_ > 1024 {
-		err_("put: Message content too big", 400, w)
-		return
+	var len_ uint32
+	var body io.ReadCloser
+	if hlen := r.Header["Content-Length"]; len(hlen) > 0 {
+		l, err := strconv.ParseUint(hlen[0], 10, 32)
+		if err != nil {
+			err_("put: Invalid content-length", 400, w)
+			return
+		}
+		if l > MAXMSGSZ {
+			err_("put: Message content too big", 400, w)
+			return
+		}
+		len_ = uint32(l)
+		body = r.Body
+	} else {
+		data, err := ioutil.ReadAll(io.LimitReader(r.Body, MAXMSGSZ+1))
+		if err != nil {
+			err_("put: Failed reading body", 400, w)
+			return
+		}
+		if len(data) > MAXMSGSZ {
+			err_("put: Message content too big", 400, w)
+			return
+		}
+		len_ = uint32(len(data))
+		body = ioutil.NopCloser(bytes.NewReader(data))
 	}
-	num, err := save(name, uint32(len_), r.Body, state)
+	num, err := save(name, len_, body, state)
 	if err != nil {
 		err_(err.Error(), 500, w)
 		return
@@ -86,167 +118,361 @@ func put(state *state, r *http.Request, w http.ResponseWriter) {
 
 /*    way/
  * Find the appropriate queue (create if doesn't exist)
- * and save the data to it
+ * and save the data to it. The whole seek-to-end/write-
+ * header/write-body/record-the-offset sequence is done under
+ * the log's own lock so concurrent `put`s to the same queue
+ * can't interleave their writes.
  */
 func save(name string, len_ uint32, inp io.ReadCloser, state *state) (int, error) {
-	mlg := findLog(name, state)
-	if mlg == nil {
-		mlg = createLog(name, state)
-		if mlg == nil {
-			return 0, errors.New("save: failed to create log")
-		}
+	mlg, err := findOrCreateLog(name, state)
+	if err != nil {
+		return 0, err
 	}
-	offset, err := saveMsg(len_, inp, mlg)
+	mlg.mu.Lock()
+	defer mlg.mu.Unlock()
+	seg, offset, ts, err := saveMsg(len_, inp, mlg)
 	if err != nil {
 		return 0, err
 	}
   recoffset := offset + RECHEADERSZ
   mlg.msgs = append(mlg.msgs, recptr {
+    seg: seg,
     off: recoffset,
     sz: len_,
+    ts: ts,
   })
+	notifyFollowers(mlg)
 	return len(mlg.msgs), nil
 }
 
-func loadLogs(state *state) {
-	files, err := ioutil.ReadDir(state.db)
-	if err != nil {
-    log.Panic("Failed to read:", state.db)
+/*    way/
+ * Look up the queue under `state`'s lock and, if it doesn't
+ * exist yet, create it before anyone else gets a chance to -
+ * without this, two `put`s racing to create the same new queue
+ * would each create their own log file for it.
+ */
+func findOrCreateLog(name string, state *state) (*msglog, error) {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	for _, l := range state.logs {
+		if strings.ToLower(l.name) == strings.ToLower(name) {
+			return l, nil
+		}
 	}
-	for _, f := range files {
-		loadLog(f, state)
+	mlg := createLog(name, state)
+	if mlg == nil {
+		return nil, errors.New("save: failed to create log")
 	}
+	return mlg, nil
 }
 
 /*    way/
- * If this looks like a log file, we read in the
- * header, then walk the records checking that
- * each starts with a valid header and keeping
- * track of the offsets and sizes
+ * Swap in a fresh notify channel and close the old one so
+ * any `follow` requests blocked waiting for this message
+ * number wake up and go re-check `mlg.msgs`.
  */
-func loadLog(inf os.FileInfo, state *state) {
-	name := inf.Name()
-	if !strings.HasSuffix(name, ".log") {
-		return
-	}
-	logfile := path.Join(state.db, name)
-	f, err := os.OpenFile(logfile, os.O_RDWR, 0644)
+func notifyFollowers(mlg *msglog) {
+	old := mlg.notify
+	mlg.notify = make(chan struct{})
+	close(old)
+}
+
+/*    way/
+ * A queue's segments are named `<name>.<seq>.log`, with the
+ * sequence number zero-padded so a plain string sort also sorts
+ * them numerically. Group the files in `state.db` by queue name and
+ * hand each group to `loadLog` to rebuild that queue.
+ */
+func loadLogs(state *state) error {
+	files, err := ioutil.ReadDir(state.db)
 	if err != nil {
-		log.Panic("loadLog:Failed to open:", f.Name, err)
+		return err
 	}
-	hdr := make([]byte, len(DBHEADER))
-	_, err = io.ReadFull(f, hdr)
-	if err != nil {
-		log.Panic("loadLog:Failed to read:", f.Name, err)
+	groups := map[string][]os.FileInfo{}
+	for _, f := range files {
+		m := SEGFILE.FindStringSubmatch(f.Name())
+		if m == nil {
+			continue
+		}
+		groups[m[1]] = append(groups[m[1]], f)
 	}
-	if bytes.Compare(DBHEADER, hdr) != 0 {
-		log.Panic("loadLog:Invalid DB header:", f.Name)
+	for name, fs := range groups {
+		if err := loadLog(name, fs, state); err != nil {
+			log.Println("loadLogs:", name, err)
+		}
 	}
+	return nil
+}
+
+/*    way/
+ * Sort this queue's segment files by sequence number, open each
+ * in turn and walk its records (checking the DB header and each
+ * record's header+CRC as we go), building one continuous
+ * message index across all segments so message numbers stay
+ * stable no matter how the log is split on disk. A bad DB
+ * header is treated as the whole queue being corrupt and bails
+ * out with an error (the caller logs and skips it, leaving
+ * other queues unaffected); a torn/corrupt *tail* record -
+ * the expected shape of damage from a crash mid-`saveMsg` - is
+ * instead repaired by truncating that segment back to the last
+ * known-good offset.
+ */
+func loadLog(name string, files []os.FileInfo, state *state) error {
+	sort.Slice(files, func(i, j int) bool { return files[i].Name() < files[j].Name() })
+	var segs []*segment
 	var msgs []recptr
-	sz := inf.Size()
-	offset := int64(len(DBHEADER))
-	for offset < sz {
-		reclen, err := getRecLen(offset, f)
+	for _, inf := range files {
+		logfile := path.Join(state.db, inf.Name())
+		f, err := os.OpenFile(logfile, os.O_RDWR, 0644)
 		if err != nil {
-			log.Panic("loadLog:", err.Error(), " at offset:", offset, " for file:", name)
+			return fmt.Errorf("loadLog: failed to open %s: %v", logfile, err)
+		}
+		hdr := make([]byte, len(DBHEADER))
+		_, err = io.ReadFull(f, hdr)
+		if err != nil {
+			return fmt.Errorf("loadLog: failed to read %s: %v", logfile, err)
+		}
+		if bytes.Compare(DBHEADER, hdr) != 0 {
+			return fmt.Errorf("loadLog: invalid DB header: %s", logfile)
 		}
-    recoffset := offset + RECHEADERSZ
-    msgs = append(msgs, recptr {
-      off: recoffset,
-      sz: reclen,
-    })
-		offset = recoffset + int64(reclen)
+		seg := &segment{
+			seq:  segSeq(inf.Name()),
+			path: logfile,
+			f:    f,
+		}
+		sz := inf.Size()
+		offset := int64(len(DBHEADER))
+		for offset < sz {
+			rec, next, err := readRecord(f, offset, sz)
+			if err != nil {
+				log.Println("loadLog:", logfile, "truncating corrupt tail at offset", offset, "-", err)
+				if err := f.Truncate(offset); err != nil {
+					return fmt.Errorf("loadLog: failed to truncate %s: %v", logfile, err)
+				}
+				sz = offset
+				break
+			}
+			rec.seg = seg
+			msgs = append(msgs, rec)
+			offset = next
+		}
+		seg.size = offset
+		segs = append(segs, seg)
 	}
-	name = name[:len(name)-len(".log")]
-	state.logs = append(state.logs, &msglog{
-		name: name,
-		f:    f,
-		msgs: msgs,
-	})
+	mlg := &msglog{
+		name:   name,
+		dir:    state.db,
+		segs:   segs,
+		msgs:   msgs,
+		notify: make(chan struct{}),
+		retain: state.retain,
+	}
+	if err := loadCursors(mlg); err != nil {
+		return fmt.Errorf("loadLog: failed to load cursors for %s: %v", name, err)
+	}
+	state.logs = append(state.logs, mlg)
+	return nil
 }
 
-func getRecLen(offset int64, f *os.File) (uint32, error) {
+/*    way/
+ * Pull the zero-padded sequence number back out of a segment's
+ * filename (the same pattern `SEGFILE` used to group it).
+ */
+func segSeq(filename string) int {
+	m := SEGFILE.FindStringSubmatch(filename)
+	seq, _ := strconv.Atoi(m[2])
+	return seq
+}
+
+func getRecHeader(offset int64, f *os.File) (uint32, int64, error) {
 	pfxsz := len(RECHEADER)
 	hdr := make([]byte, RECHEADERSZ)
 
 	if _, err := f.Seek(offset, io.SeekStart); err != nil {
-		return 0, errors.New("Seek Failed")
+		return 0, 0, errors.New("Seek Failed")
 	}
 	if _, err := io.ReadFull(f, hdr); err != nil {
-		return 0, errors.New("Read Failed")
+		return 0, 0, errors.New("Read Failed")
 	}
-	if bytes.Compare(RECHEADER, hdr[:len(RECHEADER)]) != 0 {
-		return 0, errors.New("Invalid Rec Header")
+	if bytes.Compare(RECHEADER, hdr[:pfxsz]) != 0 {
+		return 0, 0, errors.New("Invalid Rec Header")
 	}
 	if hdr[len(hdr)-1] != '\n' {
-		return 0, errors.New("Invalid header '\n'")
+		return 0, 0, errors.New("Invalid header '\n'")
+	}
+	var sz uint32
+	if err := binary.Read(bytes.NewReader(hdr[pfxsz:pfxsz+4]), binary.LittleEndian, &sz); err != nil {
+		return 0, 0, errors.New("Failed reading Rec size")
+	}
+	var ts int64
+	if err := binary.Read(bytes.NewReader(hdr[pfxsz+4:pfxsz+12]), binary.LittleEndian, &ts); err != nil {
+		return 0, 0, errors.New("Failed reading Rec timestamp")
 	}
-	b_ := bytes.NewReader(hdr[pfxsz : pfxsz+4])
-	var v uint32
-	if err := binary.Read(b_, binary.LittleEndian, &v); err != nil {
-		return 0, errors.New("Failed reading Rec size")
+	return sz, ts, nil
+}
+
+/*    way/
+ * Read one full record - header, payload, and trailing CRC32C -
+ * starting at `offset`, checking it against `sz` (the file's
+ * current length) as we go. Returns the parsed `recptr` (minus
+ * `seg`, which the caller fills in) and the offset the next
+ * record would start at. Any failure here - a bad header, a
+ * payload/trailer that runs past `sz`, or a CRC mismatch - means
+ * this is a torn or corrupted tail record rather than a
+ * globally corrupt file, so the caller repairs by truncating
+ * back to `offset` instead of giving up on the whole queue.
+ */
+func readRecord(f *os.File, offset int64, sz int64) (recptr, int64, error) {
+	reclen, ts, err := getRecHeader(offset, f)
+	if err != nil {
+		return recptr{}, 0, err
+	}
+	payoff := offset + RECHEADERSZ
+	next := payoff + int64(reclen) + CRCSZ
+	if next > sz {
+		return recptr{}, 0, errors.New("torn record: truncated payload")
 	}
-	return v, nil
+	payload := make([]byte, reclen)
+	if _, err := f.ReadAt(payload, payoff); err != nil {
+		return recptr{}, 0, err
+	}
+	trailer := make([]byte, CRCSZ)
+	if _, err := f.ReadAt(trailer, payoff+int64(reclen)); err != nil {
+		return recptr{}, 0, err
+	}
+	if binary.LittleEndian.Uint32(trailer) != crc32.Checksum(payload, crc32cTable) {
+		return recptr{}, 0, errors.New("torn record: crc mismatch")
+	}
+	return recptr{off: payoff, sz: reclen, ts: ts}, next, nil
 }
 
+/*    way/
+ * Create a brand new queue with a single, empty segment #0.
+ */
 func createLog(name string, state *state) *msglog {
-	logfile := path.Join(state.db, name+".log")
-	f, err := os.OpenFile(logfile, os.O_CREATE|os.O_RDWR, 0644)
+	seg, err := newSegment(state.db, name, 0)
 	if err != nil {
 		log.Println("createLog:", err)
 		return nil
 	}
-	_, err = f.Write(DBHEADER)
-	if err != nil {
+	mlg := &msglog{
+		name:   name,
+		dir:    state.db,
+		segs:   []*segment{seg},
+		notify: make(chan struct{}),
+		retain: state.retain,
+	}
+	if err := loadCursors(mlg); err != nil {
 		log.Println("createLog:", err)
 		return nil
 	}
-	msglog := &msglog{
-		name: name,
-		f:    f,
-		msgs: nil,
-	}
-	state.logs = append(state.logs, msglog)
-	return msglog
+	state.logs = append(state.logs, mlg)
+	return mlg
 }
 
-func saveMsg(len_ uint32, inp io.ReadCloser, mlg *msglog) (int64, error) {
-	if _, err := mlg.f.Seek(0, io.SeekEnd); err != nil {
-		return 0, err
-	}
-	inf, err := mlg.f.Stat()
+/*    way/
+ * Open (creating if needed) the segment file for `seq` and
+ * stamp it with the DB header, ready to have records appended.
+ */
+func newSegment(dir, name string, seq int) (*segment, error) {
+	p := segFilePath(dir, name, seq)
+	f, err := os.OpenFile(p, os.O_CREATE|os.O_RDWR, 0644)
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
-	if _, err := mlg.f.Write(RECHEADER); err != nil {
-		return 0, err
+	if _, err := f.Write(DBHEADER); err != nil {
+		return nil, err
 	}
-	if err := binary.Write(mlg.f, binary.LittleEndian, len_); err != nil {
-		return 0, err
+	return &segment{seq: seq, path: p, f: f, size: int64(len(DBHEADER))}, nil
+}
+
+func segFilePath(dir, name string, seq int) string {
+	return path.Join(dir, fmt.Sprintf("%s.%06d.log", name, seq))
+}
+
+/*    way/
+ * Append one record to the queue's active segment, rolling to a
+ * fresh segment first if this record would take the active one
+ * past `SEGMENTSZ` - so no single segment grows without bound and
+ * old ones become free to compact away once sealed. Returns the
+ * segment written to and the offset of the record's header
+ * within it (not including the header itself), plus the
+ * timestamp stamped on the record, for the caller to build the
+ * `recptr` from. A CRC32C of the payload is written as a
+ * trailer after it, so `loadLog` can tell a torn/corrupt tail
+ * record from a good one on restart. `offset` is taken from the
+ * file's actual end-of-file position rather than trusted from
+ * `seg.size`, and anything written from there on is truncated
+ * back off on error, so a partial write (short body, disk error)
+ * can never leave dangling garbage that throws off the next
+ * call's offset or `loadLog`'s tail recovery.
+ */
+func saveMsg(len_ uint32, inp io.ReadCloser, mlg *msglog) (seg *segment, offset int64, ts int64, err error) {
+	seg = mlg.segs[len(mlg.segs)-1]
+	if seg.size > int64(len(DBHEADER)) && seg.size+RECHEADERSZ+int64(len_)+CRCSZ > SEGMENTSZ {
+		next, e := newSegment(mlg.dir, mlg.name, seg.seq+1)
+		if e != nil {
+			return nil, 0, 0, e
+		}
+		mlg.segs = append(mlg.segs, next)
+		seg = next
 	}
-	if _, err := mlg.f.Write([]byte{'\n'}); err != nil {
-		return 0, err
+	pos, e := seg.f.Seek(0, io.SeekEnd)
+	if e != nil {
+		return nil, 0, 0, e
 	}
-	buf := make([]byte, 1024)
-	n, err := inp.Read(buf)
-	for n > 0 || err == nil {
-		if n > 0 {
-			if _, err := mlg.f.Write(buf[:n]); err != nil {
-				return 0, err
-			}
-		}
+	offset = pos
+	defer func() {
 		if err != nil {
-			break
+			seg.f.Truncate(offset)
 		}
-		n, err = inp.Read(buf)
+	}()
+	if _, e := seg.f.Write(RECHEADER); e != nil {
+		err = e
+		return
+	}
+	if e := binary.Write(seg.f, binary.LittleEndian, len_); e != nil {
+		err = e
+		return
+	}
+	ts = time.Now().Unix()
+	if e := binary.Write(seg.f, binary.LittleEndian, ts); e != nil {
+		err = e
+		return
+	}
+	if _, e := seg.f.Write([]byte{'\n'}); e != nil {
+		err = e
+		return
+	}
+	buf := writeBufPool.Get().([]byte)
+	defer writeBufPool.Put(buf)
+	crc := crc32.New(crc32cTable)
+	n, e := io.CopyBuffer(io.MultiWriter(seg.f, crc), io.LimitReader(inp, int64(len_)), buf)
+	if e != nil {
+		err = e
+		return
+	}
+	if n != int64(len_) {
+		err = errors.New("saveMsg: short body")
+		return
 	}
-	if err == io.EOF {
-		return inf.Size(), nil
+	if e := binary.Write(seg.f, binary.LittleEndian, crc.Sum32()); e != nil {
+		err = e
+		return
 	}
-	return 0, err
+	seg.size = offset + RECHEADERSZ + int64(len_) + CRCSZ
+	return seg, offset, ts, nil
+}
+
+var writeBufPool = sync.Pool{
+	New: func() interface{} {
+		return make([]byte, 32*1024)
+	},
 }
 
 func findLog(name string, state *state) *msglog {
+	state.mu.RLock()
+	defer state.mu.RUnlock()
 	for _, log := range state.logs {
 		if strings.ToLower(log.name) == strings.ToLower(name) {
 			return log
@@ -296,21 +522,434 @@ func get(state *state, r *http.Request, w http.ResponseWriter) {
 		return
 	}
   n -= 1
-	if int(n) >= len(mlg.msgs) {
+	if int(n) >= mlg.count() {
     w.WriteHeader(204)
     return
   }
+	if cv := r.URL.Query()["count"]; len(cv) > 0 {
+		count, err := strconv.ParseUint(cv[0], 10, 32)
+		if err != nil || count < 1 {
+			err_("get: Invalid count", 400, w)
+			return
+		}
+		var max_bytes int64
+		if mv := r.URL.Query()["max_bytes"]; len(mv) > 0 {
+			m, err := strconv.ParseUint(mv[0], 10, 63)
+			if err != nil {
+				err_("get: Invalid max_bytes", 400, w)
+				return
+			}
+			max_bytes = int64(m)
+		}
+		if err := sendLogRange(mlg, uint32(n), uint32(count), max_bytes, w); err != nil {
+			err_("get: "+err.Error(), 500, w)
+		}
+		return
+	}
   sendLog(mlg, uint32(n), w)
 }
 
 func sendLog(mlg *msglog, n uint32, w http.ResponseWriter) {
-	recptr := mlg.msgs[n]
-	rec := make([]byte, recptr.sz)
-	if n, _ := mlg.f.ReadAt(rec, recptr.off); n < len(rec) {
+	rec, ok := mlg.recAt(n)
+	if !ok {
+		err_("Failed reading record", 500, w)
+		return
+	}
+	if rec.seg.removed.Load() {
+		err_("get: message compacted by retention", 410, w)
+		return
+	}
+	buf := make([]byte, rec.sz)
+	if n, _ := rec.seg.f.ReadAt(buf, rec.off); n < len(buf) {
 		err_("Failed reading record", 500, w)
 		return
 	}
-	w.Write(rec)
+	w.Write(buf)
+}
+
+var readBufPool = sync.Pool{
+	New: func() interface{} {
+		return make([]byte, 32*1024)
+	},
+}
+
+/*    understand/
+ * Fetching one message per round trip caps consumer
+ * throughput. `count` lets a client pull several records out
+ * of a single response, framed the same way we already frame
+ * them on disk so a client can parse them out with the exact
+ * same header it already knows how to read.
+ *
+ *    way/
+ * Walk `mlg.msgs` starting at `n`, writing each record's header
+ * exactly as it's laid out on disk - `RECHEADER` + length +
+ * timestamp + '\n' - then its payload (the CRC32C trailer that
+ * follows the payload on disk is not sent), stopping once we've sent
+ * `count` records, hit the end of the log, hit a record that's
+ * been compacted away by retention, would exceed `max_bytes` (0
+ * means no limit), or hit a write error. Each payload is
+ * streamed straight from its segment file through a pooled
+ * buffer so we don't allocate one per request.
+ */
+func sendLogRange(mlg *msglog, n uint32, count uint32, max_bytes int64, w http.ResponseWriter) error {
+	buf := readBufPool.Get().([]byte)
+	defer readBufPool.Put(buf)
+	var sent int64
+	for i := uint32(0); i < count; i++ {
+		rec, ok := mlg.recAt(n)
+		if !ok || rec.seg.removed.Load() {
+			break
+		}
+		if max_bytes > 0 && sent+RECHEADERSZ+int64(rec.sz) > max_bytes {
+			break
+		}
+		if _, err := w.Write(RECHEADER); err != nil {
+			return err
+		}
+		if err := binary.Write(w, binary.LittleEndian, rec.sz); err != nil {
+			return err
+		}
+		if err := binary.Write(w, binary.LittleEndian, rec.ts); err != nil {
+			return err
+		}
+		if _, err := w.Write([]byte{'\n'}); err != nil {
+			return err
+		}
+		src := io.NewSectionReader(rec.seg.f, rec.off, int64(rec.sz))
+		if _, err := io.CopyBuffer(w, src, buf); err != nil {
+			return err
+		}
+		sent += RECHEADERSZ + int64(rec.sz)
+		n++
+	}
+	return nil
+}
+
+/*    understand/
+ * `get` is poll-only - the client has to keep asking "is there
+ * a next message yet?". `follow` instead keeps the connection
+ * open and streams new records as they are appended, like
+ * `tail -f`, so it can drive real pub/sub consumers.
+ *
+ *    way/
+ * Starting from `from` (1-based, same convention as `get`),
+ * for each message number in turn: if it's not in `mlg.msgs`
+ * yet, wait on the log's notify channel until `put` appends
+ * one (or the client disconnects), then write it out as a
+ * framed chunk and flush so the bytes reach the client right
+ * away. Chunked transfer-encoding is automatic here because we
+ * never set a Content-Length and we flush after every frame.
+ */
+func follow(state *state, r *http.Request, w http.ResponseWriter) {
+	name := getQueueName(r)
+	if len(name) == 0 {
+		err_("follow: Invalid/Missing queue name", 400, w)
+		return
+	}
+	mlg := findLog(name, state)
+	if mlg == nil {
+		err_("follow: No log found:"+name, 404, w)
+		return
+	}
+	n := uint32(0)
+	if qv := r.URL.Query()["from"]; len(qv) > 0 {
+		v, err := strconv.ParseUint(qv[0], 10, 32)
+		if err != nil || v < 1 {
+			err_("follow: Invalid msg number", 400, w)
+			return
+		}
+		n = uint32(v) - 1
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		err_("follow: streaming unsupported", 500, w)
+		return
+	}
+	ctx := r.Context()
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.WriteHeader(200)
+	for {
+		for {
+			ch, ready := mlg.waitFor(n)
+			if ready {
+				break
+			}
+			select {
+			case <-ch:
+			case <-ctx.Done():
+				return
+			}
+		}
+		if err := sendFollowFrame(mlg, n, w); err != nil {
+			return
+		}
+		flusher.Flush()
+		n++
+	}
+}
+
+/*    way/
+ * Write one framed message: `FRAMEHEADER`, the message's
+ * 1-based sequence number, its payload length (both little
+ * endian uint32) and a trailing '\n', then the payload itself -
+ * so a client reading one HTTP body can pull out however many
+ * frames were written to it.
+ */
+func sendFollowFrame(mlg *msglog, n uint32, w http.ResponseWriter) error {
+	rec, ok := mlg.recAt(n)
+	if !ok || rec.seg.removed.Load() {
+		return errors.New("Failed reading record")
+	}
+	buf := make([]byte, rec.sz)
+	if rn, _ := rec.seg.f.ReadAt(buf, rec.off); rn < len(buf) {
+		return errors.New("Failed reading record")
+	}
+	if _, err := w.Write(FRAMEHEADER); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.LittleEndian, n+1); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.LittleEndian, rec.sz); err != nil {
+		return err
+	}
+	if _, err := w.Write([]byte{'\n'}); err != nil {
+		return err
+	}
+	_, err := w.Write(buf)
+	return err
+}
+
+/*    understand/
+ * `get`/`follow` make the client track its own position in the
+ * queue. `next`/`commit` instead let a group of consumers share
+ * one durable, server-side cursor - `next` hands out messages
+ * without retiring them (so a crashed consumer doesn't lose its
+ * place) and `commit` is the client's explicit "I'm done through
+ * here".
+ *
+ *    way/
+ * Parse `group`, an optional `count` (default 1) and an optional
+ * `ack_timeout` (seconds; 0/absent disables automatic
+ * redelivery), hand out that many message numbers for the group,
+ * and stream each one out using the same framing `follow` uses -
+ * so a client already speaking that protocol can reuse its
+ * parser, and the frame's sequence number is exactly what it
+ * passes back to `commit`.
+ */
+func nextMsg(state *state, r *http.Request, w http.ResponseWriter) {
+	name := getQueueName(r)
+	if len(name) == 0 {
+		err_("next: Invalid/Missing queue name", 400, w)
+		return
+	}
+	mlg := findLog(name, state)
+	if mlg == nil {
+		err_("next: No log found:"+name, 404, w)
+		return
+	}
+	gv := r.URL.Query()["group"]
+	if len(gv) == 0 || isInvalidGroup(gv[0]) {
+		err_("next: Invalid/Missing group", 400, w)
+		return
+	}
+	count := uint64(1)
+	if cv := r.URL.Query()["count"]; len(cv) > 0 {
+		c, err := strconv.ParseUint(cv[0], 10, 32)
+		if err != nil || c < 1 {
+			err_("next: Invalid count", 400, w)
+			return
+		}
+		count = c
+	}
+	var ackTimeout time.Duration
+	if av := r.URL.Query()["ack_timeout"]; len(av) > 0 {
+		s, err := strconv.ParseUint(av[0], 10, 32)
+		if err != nil {
+			err_("next: Invalid ack_timeout", 400, w)
+			return
+		}
+		ackTimeout = time.Duration(s) * time.Second
+	}
+	ns := dispatchNext(mlg, gv[0], uint32(count), ackTimeout)
+	if len(ns) == 0 {
+		w.WriteHeader(204)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	for _, n := range ns {
+		if err := sendFollowFrame(mlg, n, w); err != nil {
+			err_("next: "+err.Error(), 500, w)
+			return
+		}
+	}
+}
+
+/*    way/
+ * Move `group`'s committed offset forward to `n` (1-based, same
+ * convention as `get`'s `n` and `follow`'s frame sequence
+ * numbers) and persist it to the queue's `.cursors` sidecar
+ * before responding, so a response the client has seen implies
+ * the commit is durable.
+ */
+func commit(state *state, r *http.Request, w http.ResponseWriter) {
+	name := getQueueName(r)
+	if len(name) == 0 {
+		err_("commit: Invalid/Missing queue name", 400, w)
+		return
+	}
+	mlg := findLog(name, state)
+	if mlg == nil {
+		err_("commit: No log found:"+name, 404, w)
+		return
+	}
+	gv := r.URL.Query()["group"]
+	if len(gv) == 0 || isInvalidGroup(gv[0]) {
+		err_("commit: Invalid/Missing group", 400, w)
+		return
+	}
+	nv := r.URL.Query()["n"]
+	if len(nv) == 0 {
+		err_("commit: Missing msg number", 400, w)
+		return
+	}
+	n, err := strconv.ParseUint(nv[0], 10, 32)
+	if err != nil || n < 1 {
+		err_("commit: Invalid msg number", 400, w)
+		return
+	}
+	if err := commitCursor(mlg, gv[0], uint32(n)); err != nil {
+		err_("commit: "+err.Error(), 500, w)
+		return
+	}
+	fmt.Fprintln(w, n)
+}
+
+/*    understand/
+ * Corruption checking + repair normally only happens once, on
+ * restart, in `loadLog`. This gives an operator a way to ask
+ * "is this queue's data intact right now" without restarting
+ * the server.
+ *
+ *    way/
+ * Re-run the same `readRecord` validation `loadLog` uses against
+ * every segment the queue currently has open, from the start of
+ * each file to its current size, tallying good/bad records per
+ * segment. A segment's scan stops at its first bad record, so
+ * its `bad` count is 0 or 1. Nothing on disk is touched here - repairing a corrupt
+ * tail still requires reloading the queue (restarting the
+ * server), same as today.
+ */
+func fsck(state *state, r *http.Request, w http.ResponseWriter) {
+	name := getQueueNameAfter("/admin/fsck/", r)
+	if len(name) == 0 {
+		err_("fsck: Invalid/Missing queue name", 400, w)
+		return
+	}
+	mlg := findLog(name, state)
+	if mlg == nil {
+		err_("fsck: No log found:"+name, 404, w)
+		return
+	}
+	mlg.mu.Lock()
+	defer mlg.mu.Unlock()
+	for _, seg := range mlg.segs {
+		good, bad, firstBad := fsckSegment(seg)
+		fmt.Fprintf(w, "%s: good=%d bad=%d", path.Base(seg.path), good, bad)
+		if bad > 0 {
+			fmt.Fprintf(w, " first_bad_offset=%d", firstBad)
+		}
+		fmt.Fprintln(w)
+	}
+}
+
+func fsckSegment(seg *segment) (good int, bad int, firstBad int64) {
+	inf, err := seg.f.Stat()
+	if err != nil {
+		return 0, 0, 0
+	}
+	sz := inf.Size()
+	offset := int64(len(DBHEADER))
+	for offset < sz {
+		_, next, err := readRecord(seg.f, offset, sz)
+		if err != nil {
+			bad++
+			firstBad = offset
+			break
+		}
+		good++
+		offset = next
+	}
+	return good, bad, firstBad
+}
+
+/*    understand/
+ * `mlg.retain` starts out as whatever `state.retain` was at load
+ * time (the zero value, today, since nothing ever sets it) - this
+ * is the only way to actually give a queue a retention policy, so
+ * each queue can be pruned to its own cap independently of every
+ * other queue.
+ *
+ *    way/
+ * Parse whichever of `max_bytes`, `max_age` (seconds) and
+ * `max_count` were given - 0/absent leaves that limit disabled -
+ * and swap them into the queue's policy as one unit under its
+ * lock, so `enforceRetention` never sees a partially-updated mix
+ * of old and new limits.
+ */
+func setRetention(state *state, r *http.Request, w http.ResponseWriter) {
+	name := getQueueNameAfter("/admin/retain/", r)
+	if len(name) == 0 {
+		err_("retain: Invalid/Missing queue name", 400, w)
+		return
+	}
+	mlg := findLog(name, state)
+	if mlg == nil {
+		err_("retain: No log found:"+name, 404, w)
+		return
+	}
+	var pol retention
+	if v := r.URL.Query()["max_bytes"]; len(v) > 0 {
+		n, err := strconv.ParseInt(v[0], 10, 64)
+		if err != nil || n < 0 {
+			err_("retain: Invalid max_bytes", 400, w)
+			return
+		}
+		pol.maxBytes = n
+	}
+	if v := r.URL.Query()["max_age"]; len(v) > 0 {
+		n, err := strconv.ParseUint(v[0], 10, 32)
+		if err != nil {
+			err_("retain: Invalid max_age", 400, w)
+			return
+		}
+		pol.maxAge = time.Duration(n) * time.Second
+	}
+	if v := r.URL.Query()["max_count"]; len(v) > 0 {
+		n, err := strconv.ParseUint(v[0], 10, 32)
+		if err != nil {
+			err_("retain: Invalid max_count", 400, w)
+			return
+		}
+		pol.maxCount = int(n)
+	}
+	mlg.mu.Lock()
+	mlg.retain = pol
+	mlg.mu.Unlock()
+	fmt.Fprintln(w, "ok")
+}
+
+/*    way/
+ * Like `getQueueName` but for endpoints nested one level deeper
+ * (e.g. `/admin/fsck/<queue>`) - trims the known `prefix` rather
+ * than hunting for the first `/`.
+ */
+func getQueueNameAfter(prefix string, r *http.Request) string {
+	name := strings.TrimPrefix(r.URL.Path, prefix)
+	if isInvalidName(name) {
+		return ""
+	}
+	return name
 }
 
 /*    understand/
@@ -328,21 +967,359 @@ func err_(error string, code int, w http.ResponseWriter) {
 	http.Error(w, error, code)
 }
 
+/*    understand/
+ * One background goroutine wakes on this tick and checks every
+ * queue's retention policy, so a queue with no policy set costs
+ * nothing beyond the check itself.
+ *
+ *    way/
+ * Snapshot the current queue list (under `state`'s lock, since
+ * `put` can append to it) and enforce each one's retention in
+ * turn, forever, once per `RETENTIONINTERVAL`.
+ */
+func retentionLoop(state *state) {
+	for {
+		time.Sleep(RETENTIONINTERVAL)
+		state.mu.RLock()
+		logs := make([]*msglog, len(state.logs))
+		copy(logs, state.logs)
+		state.mu.RUnlock()
+		for _, mlg := range logs {
+			enforceRetention(mlg)
+		}
+	}
+}
+
+/*    way/
+ * Retention only ever deletes whole *sealed* segments - never
+ * the active one we might still be appending to - so it walks
+ * the sealed segments oldest-first and keeps dropping the
+ * oldest while any configured limit (total bytes, total message
+ * count, or age - a segment is past the age limit once even its
+ * newest message is older than it) is still being breached.
+ * Message numbers in `mlg.msgs` are left untouched so
+ * numbering for everything after a dropped segment doesn't
+ * shift; `sendLog` answers a read that lands on a dropped
+ * segment with 410 (compacted away), and `sendLogRange` stops
+ * its batch at such a record.
+ */
+func enforceRetention(mlg *msglog) {
+	mlg.mu.Lock()
+	defer mlg.mu.Unlock()
+	pol := mlg.retain
+	if pol.maxBytes == 0 && pol.maxAge == 0 && pol.maxCount == 0 {
+		return
+	}
+	if len(mlg.segs) <= 1 {
+		return
+	}
+	sealed := mlg.segs[:len(mlg.segs)-1]
+	active := mlg.segs[len(mlg.segs)-1]
+
+	var totalBytes int64
+	var kept int
+	for _, s := range mlg.segs {
+		totalBytes += s.size
+		kept += segMsgCount(mlg.msgs, s)
+	}
+
+	i := 0
+	for i < len(sealed) {
+		s := sealed[i]
+		over := false
+		if pol.maxBytes > 0 && totalBytes > pol.maxBytes {
+			over = true
+		}
+		if pol.maxCount > 0 && kept > pol.maxCount {
+			over = true
+		}
+		if pol.maxAge > 0 && time.Since(time.Unix(segLastTime(mlg.msgs, s), 0)) > pol.maxAge {
+			over = true
+		}
+		if !over {
+			break
+		}
+		removeSegment(s)
+		totalBytes -= s.size
+		kept -= segMsgCount(mlg.msgs, s)
+		i++
+	}
+	mlg.segs = append(append([]*segment{}, sealed[i:]...), active)
+}
+
+func segMsgCount(msgs []recptr, seg *segment) int {
+	n := 0
+	for _, r := range msgs {
+		if r.seg == seg {
+			n++
+		}
+	}
+	return n
+}
+
+func segLastTime(msgs []recptr, seg *segment) int64 {
+	var last int64
+	for _, r := range msgs {
+		if r.seg == seg && r.ts > last {
+			last = r.ts
+		}
+	}
+	return last
+}
+
+func removeSegment(s *segment) {
+	s.removed.Store(true)
+	s.f.Close()
+	os.Remove(s.path)
+}
+
+/*    understand/
+ * A queue's log is split across segment files (`<name>.NNNNNN.log`)
+ * capped at `SEGMENTSZ` each so no single file grows without
+ * bound and sealed segments become free to compact away under
+ * retention.
+ */
+type segment struct {
+	seq     int
+	path    string
+	f       *os.File
+	size    int64
+	removed atomic.Bool /* set by removeSegment; read lock-free by sendLog/sendLogRange/sendFollowFrame */
+}
+
+/*    understand/
+ * How long to keep a queue's data, enforced at whole-segment
+ * granularity by `enforceRetention`. Zero on a field means that
+ * limit is disabled.
+ */
+type retention struct {
+	maxBytes int64
+	maxAge   time.Duration
+	maxCount int
+}
+
 type msglog struct {
-	name string
-	f    *os.File
-	msgs []recptr
+	name        string
+	dir         string
+	segs        []*segment
+	msgs        []recptr
+	notify      chan struct{}
+	mu          sync.Mutex
+	retain      retention
+	cursors     map[string]*cursor
+	cursorsFile *os.File
+}
+
+/*    understand/
+ * A durable, named position in the log for one consumer group -
+ * everything below `committed` is done. `next`/`inflight` are
+ * kept in memory only: they just steer dispatch, and losing them
+ * on a crash merely causes some already-dispatched-but-uncommitted
+ * messages to be redelivered, which at-least-once delivery
+ * already has to tolerate.
+ */
+type cursor struct {
+	committed uint32
+	next      uint32
+	inflight  map[uint32]time.Time
+}
+
+/*    way/
+ * Look up (creating if this is the group's first request) the
+ * cursor for `group`. Must be called with `mlg.mu` held.
+ */
+func groupCursor(mlg *msglog, group string) *cursor {
+	cur, ok := mlg.cursors[group]
+	if !ok {
+		cur = &cursor{inflight: map[uint32]time.Time{}}
+		mlg.cursors[group] = cur
+	}
+	return cur
+}
+
+/*    way/
+ * Advance `group`'s committed offset to `n` (a client can only
+ * move it forward, never back) and drop any in-flight tracking
+ * below it - those messages are acked now, whether or not this
+ * consumer was the one they were dispatched to. Every commit is
+ * appended to the queue's `.cursors` sidecar and fsync'd before
+ * we return, so a commit a client has seen acknowledged survives
+ * a crash.
+ */
+func commitCursor(mlg *msglog, group string, n uint32) error {
+	mlg.mu.Lock()
+	defer mlg.mu.Unlock()
+	cur := groupCursor(mlg, group)
+	if n <= cur.committed {
+		return nil
+	}
+	cur.committed = n
+	if n > cur.next {
+		cur.next = n
+	}
+	for idx := range cur.inflight {
+		if idx < n {
+			delete(cur.inflight, idx)
+		}
+	}
+	return persistCommit(mlg, group, n)
+}
+
+/*    way/
+ * Hand out up to `count` message numbers for `group`: first any
+ * in-flight messages whose `ackTimeout` has expired (oldest
+ * first, so redelivery doesn't starve later messages), then
+ * fresh ones off the end of the log. `ackTimeout` of 0 means
+ * dispatched messages are never automatically redelivered - only
+ * an explicit commit retires them.
+ */
+func dispatchNext(mlg *msglog, group string, count uint32, ackTimeout time.Duration) []uint32 {
+	mlg.mu.Lock()
+	defer mlg.mu.Unlock()
+	cur := groupCursor(mlg, group)
+	now := time.Now()
+	var deadline time.Time
+	if ackTimeout > 0 {
+		deadline = now.Add(ackTimeout)
+	}
+	var result []uint32
+	var expired []uint32
+	for idx, dl := range cur.inflight {
+		if !dl.IsZero() && now.After(dl) {
+			expired = append(expired, idx)
+		}
+	}
+	sort.Slice(expired, func(i, j int) bool { return expired[i] < expired[j] })
+	for _, idx := range expired {
+		if uint32(len(result)) >= count {
+			return result
+		}
+		cur.inflight[idx] = deadline
+		result = append(result, idx)
+	}
+	for uint32(len(result)) < count && cur.next < uint32(len(mlg.msgs)) {
+		idx := cur.next
+		cur.inflight[idx] = deadline
+		result = append(result, idx)
+		cur.next++
+	}
+	return result
+}
+
+/*    way/
+ * Open (creating if it doesn't exist yet) the queue's
+ * `.cursors` sidecar and load every group's last-committed offset
+ * from it - lines are appended one per commit, so the last line
+ * for a group wins.
+ */
+func loadCursors(mlg *msglog) error {
+	p := path.Join(mlg.dir, mlg.name+".cursors")
+	f, err := os.OpenFile(p, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	mlg.cursorsFile = f
+	mlg.cursors = map[string]*cursor{}
+	data, err := ioutil.ReadFile(p)
+	if err != nil {
+		return err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if line == "" {
+			continue
+		}
+		parts := strings.SplitN(line, "\t", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		n, err := strconv.ParseUint(parts[1], 10, 32)
+		if err != nil {
+			continue
+		}
+		mlg.cursors[parts[0]] = &cursor{committed: uint32(n), next: uint32(n), inflight: map[uint32]time.Time{}}
+	}
+	return nil
+}
+
+/*    way/
+ * Append one `group<TAB>n` line and fsync it - the durability
+ * guarantee a committed offset needs to survive a crash.
+ */
+func persistCommit(mlg *msglog, group string, n uint32) error {
+	if _, err := fmt.Fprintf(mlg.cursorsFile, "%s\t%d\n", group, n); err != nil {
+		return err
+	}
+	return mlg.cursorsFile.Sync()
+}
+
+func isInvalidGroup(g string) bool {
+	return len(g) == 0 || strings.ContainsAny(g, "\t\n")
+}
+
+/*    way/
+ * Snapshot how many messages are in the log right now, under
+ * the log's lock, so callers never see `msgs` mid-append.
+ */
+func (mlg *msglog) count() int {
+	mlg.mu.Lock()
+	defer mlg.mu.Unlock()
+	return len(mlg.msgs)
+}
+
+/*    way/
+ * Snapshot the segment/offset/size of message `n` under the
+ * log's lock. Once handed back, the record itself never changes
+ * (the log is append-only, and a removed segment is never
+ * reused) so the actual file read can safely happen outside the
+ * lock.
+ */
+func (mlg *msglog) recAt(n uint32) (recptr, bool) {
+	mlg.mu.Lock()
+	defer mlg.mu.Unlock()
+	if int(n) >= len(mlg.msgs) {
+		return recptr{}, false
+	}
+	return mlg.msgs[n], true
+}
+
+/*    way/
+ * Check whether message `n` exists yet and, if not, snapshot the
+ * current notify channel to wait on - both under the same lock,
+ * condvar-style, so a `put` landing between the check and the
+ * snapshot can't swap+close the channel before the caller ever
+ * starts watching it (which would otherwise strand the wait on
+ * the new, still-open channel until some unrelated later message
+ * happens to land).
+ */
+func (mlg *msglog) waitFor(n uint32) (ch chan struct{}, ready bool) {
+	mlg.mu.Lock()
+	defer mlg.mu.Unlock()
+	if int(n) < len(mlg.msgs) {
+		return nil, true
+	}
+	return mlg.notify, false
 }
 
 type state struct {
 	addr string
 	db   string
 	logs []*msglog
+	mu   sync.RWMutex
+	retain retention
 }
 
+/*    understand/
+ * Where a message lives: which segment file, at what offset
+ * (just past its `RECHEADER`) and how big it is. Kept
+ * separately from the segment's on-disk position so the message
+ * number -> recptr index stays dense even once old segments get
+ * dropped out from under it.
+ */
 type recptr struct {
+  seg *segment
   off int64
   sz uint32
+  ts int64
 }
 
 type reqHandler func(*state, *http.Request, http.ResponseWriter)
@@ -350,4 +1327,15 @@ type httpHandler func(http.ResponseWriter, *http.Request)
 
 var DBHEADER = []byte("EE|v1|")
 var RECHEADER = []byte("\n|EE|")
-var RECHEADERSZ = int64(len(RECHEADER) + 4 + 1) /* 4: uint32 len + 1: '\n' */
+var RECHEADERSZ = int64(len(RECHEADER) + 4 + 8 + 1) /* 4: uint32 len + 8: int64 timestamp + 1: '\n' */
+
+var FRAMEHEADER = []byte("\n|EF|") /* seq(4) + len(4) + '\n' follow */
+
+var SEGFILE = regexp.MustCompile(`^(.+)\.(\d{6})\.log$`)
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+const MAXMSGSZ = 1024              /* largest message body `put` will accept */
+const SEGMENTSZ = 64 * 1024 * 1024 /* roll a new segment before a record would take the active one past this */
+const RETENTIONINTERVAL = time.Minute
+const CRCSZ = 4 /* uint32 CRC32C trailer written after each record's payload */